@@ -1,17 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jacoblai/rrframework/logs"
 	"github.com/jacoblai/rrframework/storage"
 
-	"github.com/jacoblai/rrframework/connector/redis"
-
 	"github.com/jacoblai/laosj/downloader"
+	"github.com/jacoblai/laosj/queue"
 	"github.com/jacoblai/laosj/sources"
 
 	"github.com/urfave/cli"
@@ -25,6 +28,29 @@ type AppConfig struct {
 	Redis        string
 	Dir          string
 	ReceiverSize int
+
+	// storage backend selection
+	Storage    string
+	S3Bucket   string
+	S3Endpoint string
+	S3Region   string
+	S3Prefix   string
+
+	// redis connectivity, beyond the plain ip:port in Redis
+	RedisPassword    string
+	RedisDB          int
+	RedisTLS         bool
+	RedisMasterName  string
+	RedisSentinels   string
+	RedisClusterAddr string
+
+	// on-disk queue, used in DISKQUEUE mode
+	DiskQueueSegmentSize int64
+	DiskQueueSyncEvery   int64
+	DiskQueueMaxMsgSize  int
+
+	// progress reporting
+	Progress string
 }
 
 var appConfig *AppConfig
@@ -32,28 +58,134 @@ var appConfig *AppConfig
 func init() {
 	appConfig = &AppConfig{}
 }
+
+// newStorage builds the rrstorage.StorageWrapper backing a source's
+// downloads, picking between local disk and S3-compatible object storage
+// based on appConfig.Storage.
+func newStorage(subdir string) (rrstorage.StorageWrapper, error) {
+	switch appConfig.Storage {
+	case "s3":
+		return downloader.NewS3Storage(downloader.S3StorageConfig{
+			Bucket:   appConfig.S3Bucket,
+			Endpoint: appConfig.S3Endpoint,
+			Region:   appConfig.S3Region,
+			Prefix:   strings.TrimSuffix(appConfig.S3Prefix, "/") + "/" + subdir,
+		})
+	case "", "local":
+		// downloader.LocalDiskStorage, not rrstorage.CreateLocalDiskStorage:
+		// it also implements StreamStorageWrapper, so download() can stream
+		// straight to disk instead of buffering the whole body in memory.
+		return downloader.NewLocalDiskStorage(strings.TrimSuffix(appConfig.Dir, "/") + "/" + subdir), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", appConfig.Storage)
+	}
+}
+
+// redisConfig builds a queue.Config from appConfig, so the same flags drive
+// a standalone instance, a Sentinel-monitored master or a Cluster.
+func redisConfig() queue.Config {
+	cfg := queue.Config{
+		Addr:       appConfig.Redis,
+		Password:   appConfig.RedisPassword,
+		DB:         appConfig.RedisDB,
+		UseTLS:     appConfig.RedisTLS,
+		MasterName: appConfig.RedisMasterName,
+	}
+	if appConfig.RedisSentinels != "" {
+		cfg.SentinelAddrs = strings.Split(appConfig.RedisSentinels, ",")
+	}
+	if appConfig.RedisClusterAddr != "" {
+		cfg.ClusterAddrs = strings.Split(appConfig.RedisClusterAddr, ",")
+	}
+	return cfg
+}
+
+// runningDownloader is the common surface every downloader implementation
+// exposes, letting runWithSignals handle any of them the same way.
+type runningDownloader interface {
+	Start()
+	Stop()
+}
+
+// runWithSignals starts d and blocks until it finishes on its own, or until
+// SIGINT/SIGTERM arrives, in which case it calls Stop() and waits for d to
+// unwind before returning, so partial progress is preserved. progress (if
+// not nil) is Finish()ed either way.
+func runWithSignals(d runningDownloader, progress *downloader.Progress) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	done := make(chan struct{})
+	go func() {
+		d.Start()
+		close(done)
+	}()
+
+	select {
+	case <-sig:
+		d.Stop()
+		<-done
+	case <-done:
+	}
+	progress.Finish()
+}
+
 func startRealTimeDownloader(source sources.SourceWrapper) {
+	store, err := newStorage(source.Name())
+	if err != nil {
+		logs.Error("building storage for %s failed, %s", source.Name(), err)
+		return
+	}
+	progress := downloader.NewProgress(downloader.ProgressMode(appConfig.Progress), 0)
 	d := &downloader.RealtimeDownloader{
 		ConcurrencyLimit: appConfig.DClimit,
 		UrlChannelFactor: 10,
-		Store:            rrstorage.CreateLocalDiskStorage(strings.TrimSuffix(appConfig.Dir, "/") + "/" + source.Name() + "/"),
+		Store:            store,
+		Urls:             source.Receiver(),
+		Progress:         progress,
+	}
+	runWithSignals(d, progress)
+}
+func startDiskQueueDownloader(source sources.SourceWrapper) {
+	store, err := newStorage(source.Name())
+	if err != nil {
+		logs.Error("building storage for %s failed, %s", source.Name(), err)
+		return
+	}
+	progress := downloader.NewProgress(downloader.ProgressMode(appConfig.Progress), 0)
+	d := &downloader.DiskQueueDownloader{
+		ConcurrencyLimit: appConfig.DClimit,
+		Dir:              appConfig.Dir,
+		Name:             source.Name(),
+		Store:            store,
 		Urls:             source.Receiver(),
+		UrlChannelFactor: 10,
+		MaxBytesPerFile:  appConfig.DiskQueueSegmentSize,
+		MaxMsgSize:       int32(appConfig.DiskQueueMaxMsgSize),
+		SyncEvery:        appConfig.DiskQueueSyncEvery,
+		SyncTimeout:      2 * time.Second,
+		Progress:         progress,
 	}
-	d.Start()
+	runWithSignals(d, progress)
 }
+
 func dealMode(source sources.SourceWrapper) error {
 	switch appConfig.Mode {
 	case downloader.REALTIME:
 		startRealTimeDownloader(source)
 		break
+	case downloader.DISKQUEUE:
+		startDiskQueueDownloader(source)
+		break
 	case downloader.REDIS:
 		// connect to redis
-		err, rc := rrredis.GetRedisClient(appConfig.Redis)
+		rc, err := queue.New(redisConfig())
 		if err != nil {
 			return err
 		}
 		for v := range source.Receiver() {
-			if _, err := rc.RPush(source.Destination(), v.V); err != nil {
+			if err := rc.RPush(context.Background(), source.Destination(), v.V); err != nil {
 				logs.Error("push", v.V, "to", source.Destination(), "failed")
 			}
 		}
@@ -108,7 +240,25 @@ func mzituHandler(c *cli.Context) error {
 }
 
 func drainHandler(c *cli.Context) error {
-	// TODO
+	store, err := newStorage("drain")
+	if err != nil {
+		return err
+	}
+	progress := downloader.NewProgress(downloader.ProgressMode(appConfig.Progress), 0)
+	d := &downloader.RedisDownloader{
+		ConcurrencyLimit: appConfig.DClimit,
+		RedisConfig:      redisConfig(),
+		SourceQueue:      c.String("sq"),
+		Store:            store,
+		UrlChannelFactor: 10,
+		Progress:         progress,
+		SkipDownloaded:   c.Bool("resume"),
+		DedupTTL:         time.Duration(c.Int("dedup-ttl")) * 24 * time.Hour,
+		MaxRetries:       int64(c.Int("max-retries")),
+		RetryBackoff:     time.Duration(c.Int("retry-backoff")) * time.Second,
+		Naming:           downloader.Naming(c.String("naming")),
+	}
+	runWithSignals(d, progress)
 	return nil
 }
 
@@ -219,6 +369,30 @@ func main() {
 					Value: downloader.URL_KEY_PREFIX,
 					Usage: "key for url queue",
 				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "also skip urls that already exhausted max-retries before a restart, without issuing an HTTP request",
+				},
+				cli.IntFlag{
+					Name:  "dedup-ttl",
+					Value: 30,
+					Usage: "days before a dedup cache entry expires and the url may be re-crawled, 0 means never",
+				},
+				cli.IntFlag{
+					Name:  "max-retries",
+					Value: 5,
+					Usage: "give up on a url after this many retries (max-retries+1 failed attempts), 0 means unlimited",
+				},
+				cli.IntFlag{
+					Name:  "retry-backoff",
+					Value: 2,
+					Usage: "base backoff in seconds before requeueing a failed url, doubled per attempt",
+				},
+				cli.StringFlag{
+					Name:  "naming",
+					Value: "url",
+					Usage: "file naming scheme: url, hash, or hash-tree",
+				},
 			},
 		},
 	}
@@ -243,15 +417,45 @@ func main() {
 		cli.IntFlag{
 			Name:        "mode, m",
 			Value:       downloader.REALTIME,
-			Usage:       "choose download mode, realtime downloading or put url into redis queue",
+			Usage:       "choose download mode: realtime downloading, put url into redis queue, or persist to a local diskqueue",
 			Destination: &appConfig.Mode,
 		},
 		cli.StringFlag{
 			Name:        "redis, r",
 			Value:       "127.0.0.1:6379",
-			Usage:       "redis ip:port",
+			Usage:       "redis ip:port, used for standalone mode",
 			Destination: &appConfig.Redis,
 		},
+		cli.StringFlag{
+			Name:        "redis-password",
+			Usage:       "redis AUTH password",
+			Destination: &appConfig.RedisPassword,
+		},
+		cli.IntFlag{
+			Name:        "redis-db",
+			Usage:       "redis DB number",
+			Destination: &appConfig.RedisDB,
+		},
+		cli.BoolFlag{
+			Name:        "redis-tls",
+			Usage:       "connect to redis over TLS",
+			Destination: &appConfig.RedisTLS,
+		},
+		cli.StringFlag{
+			Name:        "redis-master-name",
+			Usage:       "sentinel master name, use together with --redis-sentinels",
+			Destination: &appConfig.RedisMasterName,
+		},
+		cli.StringFlag{
+			Name:        "redis-sentinels",
+			Usage:       "comma separated sentinel addresses, e.g. 10.0.0.1:26379,10.0.0.2:26379",
+			Destination: &appConfig.RedisSentinels,
+		},
+		cli.StringFlag{
+			Name:        "redis-cluster-addrs",
+			Usage:       "comma separated redis cluster addresses, enables cluster mode",
+			Destination: &appConfig.RedisClusterAddr,
+		},
 		cli.StringFlag{
 			Name:        "directory, dir",
 			Value:       "/Volumes/jacoblai/sexx",
@@ -264,6 +468,57 @@ func main() {
 			Usage:       "set the size of channel which used by source to cache urls",
 			Destination: &appConfig.ReceiverSize,
 		},
+		cli.StringFlag{
+			Name:        "storage",
+			Value:       "local",
+			Usage:       "storage backend for downloaded images, local or s3",
+			Destination: &appConfig.Storage,
+		},
+		cli.StringFlag{
+			Name:        "s3-bucket",
+			Usage:       "s3 bucket name, required when --storage=s3",
+			Destination: &appConfig.S3Bucket,
+		},
+		cli.StringFlag{
+			Name:        "s3-endpoint",
+			Usage:       "s3-compatible endpoint, leave blank for AWS S3 itself",
+			Destination: &appConfig.S3Endpoint,
+		},
+		cli.StringFlag{
+			Name:        "s3-region",
+			Value:       "us-east-1",
+			Usage:       "s3 region",
+			Destination: &appConfig.S3Region,
+		},
+		cli.StringFlag{
+			Name:        "s3-prefix",
+			Usage:       "key prefix under the bucket, no leading slash",
+			Destination: &appConfig.S3Prefix,
+		},
+		cli.Int64Flag{
+			Name:        "dq-segment-size",
+			Value:       100 * 1024 * 1024,
+			Usage:       "diskqueue mode: max bytes per segment file before rolling to a new one",
+			Destination: &appConfig.DiskQueueSegmentSize,
+		},
+		cli.Int64Flag{
+			Name:        "dq-sync-every",
+			Value:       1000,
+			Usage:       "diskqueue mode: fsync after this many writes",
+			Destination: &appConfig.DiskQueueSyncEvery,
+		},
+		cli.IntFlag{
+			Name:        "dq-max-msg-size",
+			Value:       1024 * 1024,
+			Usage:       "diskqueue mode: largest single url message accepted, in bytes",
+			Destination: &appConfig.DiskQueueMaxMsgSize,
+		},
+		cli.StringFlag{
+			Name:        "progress",
+			Value:       "bar",
+			Usage:       "progress reporting: bar, json, or none",
+			Destination: &appConfig.Progress,
+		},
 	}
 	err := app.Run(os.Args)
 	if err != nil {
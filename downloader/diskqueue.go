@@ -0,0 +1,220 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jacoblai/rrframework/logs"
+	"github.com/jacoblai/rrframework/storage"
+	"github.com/nsqio/go-diskqueue"
+)
+
+// DISKQUEUE continues the REALTIME/REDIS mode enum: it persists crawled
+// urls to a local on-disk queue instead of requiring a Redis server.
+const DISKQUEUE = 2
+
+// DiskQueueDownloader gets urls from Urls, persists them to a local,
+// segmented append-only log (github.com/nsqio/go-diskqueue) so they survive
+// a restart, then downloads them concurrently and saves the binary to
+// storage. It offers the same Start/Stop/WaitCloser surface as
+// RedisDownloader so callers can swap between the two without touching the
+// rest of the pipeline.
+type DiskQueueDownloader struct {
+	// exported
+	ConcurrencyLimit int                      // max number of goroutines to download
+	Dir              string                   // base dir, segments live under Dir/.queue/Name
+	Name             string                   // queue name, usually the source name
+	Store            rrstorage.StorageWrapper // for saving downloaded binary
+	Urls             <-chan Url               // crawled urls to persist and download
+	UrlChannelFactor int
+
+	MaxBytesPerFile int64         // segment size before rolling to a new file
+	MaxMsgSize      int32         // largest single message (url) accepted
+	SyncEvery       int64         // fsync after this many writes
+	SyncTimeout     time.Duration // fsync at least this often
+	Progress        *Progress     // renders run stats; nil is fine, behaves as ProgressNone
+
+	// inner use
+	sema chan struct{}       // for concurrency-limiting
+	flag chan struct{}       // stop flag
+	urls chan Url            // url channel queue, fed from the disk queue
+	dq   diskqueue.Interface // on-disk segmented log
+}
+
+func (s *DiskQueueDownloader) queueDir() string {
+	return strings.TrimSuffix(s.Dir, "/") + "/.queue/" + s.Name
+}
+
+// Start DiskQueueDownloader
+func (s *DiskQueueDownloader) Start() {
+	dqLog := func(lvl diskqueue.LogLevel, f string, args ...interface{}) {
+		logs.Info(fmt.Sprintf("[diskqueue %s] ", s.Name) + fmt.Sprintf(f, args...))
+	}
+	// diskqueue writes segments into queueDir but does not create it
+	if err := os.MkdirAll(s.queueDir(), 0755); err != nil {
+		logs.Error("Start DiskQueueDownloader fail %s", err)
+		return
+	}
+	s.dq = diskqueue.New(s.Name, s.queueDir(), s.MaxBytesPerFile, 1, s.MaxMsgSize, s.SyncEvery, s.SyncTimeout, dqLog)
+
+	// create channel
+	s.sema = make(chan struct{}, s.ConcurrencyLimit)
+	s.flag = make(chan struct{})
+	s.urls = make(chan Url, s.ConcurrencyLimit*s.UrlChannelFactor)
+
+	go func() {
+		// persist every crawled url before it's downloaded, so a crash
+		// doesn't lose it
+		for url := range s.Urls {
+			if err := s.dq.Put([]byte(url.V)); err != nil {
+				logs.Error("persist %s to diskqueue failed, %s", url.V, err)
+			}
+		}
+	}()
+
+	go func() {
+		s.readFromDiskQueue()
+		// producer stopped (flag was closed): close s.urls so a pending
+		// `url, ok := <-s.urls` in the main loop below unblocks instead of
+		// hanging forever, same fix as RedisDownloader's s.urls
+		close(s.urls)
+	}()
+
+	tick := time.Tick(2 * time.Second)
+	logs.Info("diskqueue downloader started.")
+
+loop2:
+	for {
+		select {
+		case <-s.flag:
+			// be stopped
+			break loop2
+		case s.sema <- struct{}{}:
+			// s.sema not full
+			url, ok := <-s.urls
+			if !ok {
+				// channel closed
+				logs.Error("Channel s.urls may be closed")
+				break loop2
+			}
+			go func() {
+				n, err := s.download(url.V)
+				if err != nil {
+					// download fail, push back to the disk queue
+					logs.Error("Download %s fail, %s", url.V, err)
+					if err := s.dq.Put([]byte(url.V)); err != nil {
+						logs.Error("Push back to diskqueue failed, %s", err)
+					}
+					s.Progress.Failed()
+				} else {
+					s.Progress.Completed(n)
+				}
+			}()
+		case <-tick:
+			// report queue depth / in-flight count, replacing the old
+			// every-2-seconds log line
+			s.Progress.Report(len(s.urls), len(s.sema))
+		}
+	}
+}
+
+// Stop DiskQueueDownloader
+func (s *DiskQueueDownloader) Stop() {
+	close(s.flag)
+	s.dq.Close()
+}
+
+// WaitCloser waits until the on-disk queue has drained.
+func (s *DiskQueueDownloader) WaitCloser() {
+loop:
+	for {
+		select {
+		case <-time.After(1 * time.Second):
+			if len(s.urls) > 0 || len(s.sema) > 1 {
+				continue
+			}
+			if s.dq.Depth() != 0 {
+				continue
+			}
+			break loop
+		}
+	}
+}
+
+// download fetches url and saves it to s.Store, returning the number of
+// bytes written.
+func (s *DiskQueueDownloader) download(url string) (int64, error) {
+
+	defer func() { <-s.sema }() // release
+
+	logs.Info("Downloading %s", url)
+	client := http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) { return net.DialTimeout(network, addr, 3*time.Second) },
+		},
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, fmt.Errorf("StatusCode %d", response.StatusCode)
+	}
+
+	urlv := strings.Split(url, "/")
+	if len(urlv) < 1 {
+		return 0, fmt.Errorf("invalid url %s", url)
+	}
+	filename := urlv[len(urlv)-1]
+
+	if streamer, ok := s.Store.(StreamStorageWrapper); ok {
+		return streamer.SaveStream(response.Body, filename)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.Store.Save(buf.Bytes(), filename); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *DiskQueueDownloader) readFromDiskQueue() {
+	for {
+		select {
+		case <-s.flag:
+			return
+		case data := <-s.dq.ReadChan():
+			select {
+			case <-s.flag:
+				return
+			case s.urls <- Url{V: string(data)}:
+				// trying to push url to urls channel
+			}
+		}
+	}
+}
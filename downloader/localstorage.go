@@ -0,0 +1,61 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalDiskStorage implements rrstorage.StorageWrapper and
+// StreamStorageWrapper by writing straight to files under Dir, so download()
+// can stream a response body to disk instead of buffering it fully in memory
+// first, same as S3Storage does for object storage.
+type LocalDiskStorage struct {
+	Dir string // base directory; trailing slash optional
+}
+
+// NewLocalDiskStorage builds a LocalDiskStorage rooted at dir.
+func NewLocalDiskStorage(dir string) *LocalDiskStorage {
+	return &LocalDiskStorage{Dir: strings.TrimSuffix(dir, "/")}
+}
+
+func (s *LocalDiskStorage) path(filename string) string {
+	return s.Dir + "/" + filename
+}
+
+// Save implements rrstorage.StorageWrapper.
+func (s *LocalDiskStorage) Save(b []byte, filename string) error {
+	_, err := s.SaveStream(bytes.NewReader(b), filename)
+	return err
+}
+
+// SaveStream implements StreamStorageWrapper, copying r straight into the
+// destination file instead of buffering it in memory first.
+func (s *LocalDiskStorage) SaveStream(r io.Reader, filename string) (int64, error) {
+	full := s.path(filename)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(full)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(f, r)
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"path"
+	"strings"
+)
+
+// Naming selects how RedisDownloader names files it saves to Store.
+type Naming string
+
+const (
+	NamingURL      Naming = "url"       // last path segment of the url (legacy default)
+	NamingHash     Naming = "hash"      // sha256 of the body, flat
+	NamingHashTree Naming = "hash-tree" // sha256 of the body, sharded ab/cd/<hash><ext>
+)
+
+// URL_HASH_KEY maps a content hash to the first url observed producing it,
+// so byte-identical images pulled from different urls are only saved once.
+const URL_HASH_KEY = URL_KEY_PREFIX + ":HASHES"
+
+// extByContentType maps the image content types this crawler actually deals
+// with to their canonical extension. mime.ExtensionsByType returns an
+// alphabetically-sorted, OS-dependent list (e.g. ".jpe" before ".jpg" for
+// "image/jpeg"), so it isn't usable as-is for naming=hash/hash-tree.
+var extByContentType = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// extFor derives a file extension from an HTTP Content-Type header, falling
+// back to whatever suffix the url itself carries.
+func extFor(contentType, url string) string {
+	if contentType != "" {
+		if ext, ok := extByContentType[strings.Split(contentType, ";")[0]]; ok {
+			return ext
+		}
+	}
+	return path.Ext(url)
+}
+
+// hashFilename builds the storage path for naming=hash / naming=hash-tree:
+// <hex sha256><ext>, optionally sharded into a 2-char/2-char directory tree
+// so a single directory doesn't end up with millions of entries.
+func hashFilename(naming Naming, hash, contentType, url string) string {
+	ext := extFor(contentType, url)
+	if naming == NamingHashTree {
+		return hash[0:2] + "/" + hash[2:4] + "/" + hash + ext
+	}
+	return hash + ext
+}
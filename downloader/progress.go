@@ -0,0 +1,131 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// ProgressMode selects how a downloader reports its progress.
+type ProgressMode string
+
+const (
+	ProgressBar  ProgressMode = "bar"  // live terminal progress bar
+	ProgressJSON ProgressMode = "json" // newline-delimited stats records
+	ProgressNone ProgressMode = "none" // no output at all
+)
+
+// Stats is one newline-delimited record emitted in ProgressJSON mode,
+// suitable for piping into monitoring.
+type Stats struct {
+	Timestamp  int64 `json:"timestamp"`
+	QueueDepth int   `json:"queue_depth"`
+	InFlight   int   `json:"in_flight"`
+	Completed  int64 `json:"completed"`
+	Failed     int64 `json:"failed"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// Progress tracks completed/failed counts and bytes downloaded across
+// goroutines, rendering them as a live bar, json lines, or nothing,
+// depending on Mode. The zero value with Mode left blank behaves as
+// ProgressNone.
+type Progress struct {
+	Mode ProgressMode
+
+	completed int64
+	failed    int64
+	bytes     int64
+
+	bar *pb.ProgressBar
+}
+
+// NewProgress creates a Progress renderer. total may be 0 when the number of
+// urls to download isn't known upfront (redis/diskqueue modes); the bar then
+// counts up instead of showing a percentage.
+func NewProgress(mode ProgressMode, total int) *Progress {
+	p := &Progress{Mode: mode}
+	if mode == ProgressBar {
+		tmpl := `{{counters . }} urls:{{string . "completed"}} inflight:{{string . "inflight"}} {{bar . }} {{speed . }} {{rtime . "ETA %s"}}`
+		p.bar = pb.ProgressBarTemplate(tmpl).Start(total)
+		p.bar.Set(pb.Bytes, true)
+		p.bar.Set("completed", int64(0))
+		p.bar.Set("inflight", 0)
+	}
+	return p
+}
+
+// Completed records a successfully downloaded url of n bytes.
+func (p *Progress) Completed(n int64) {
+	if p == nil {
+		return
+	}
+	completed := atomic.AddInt64(&p.completed, 1)
+	atomic.AddInt64(&p.bytes, n)
+	if p.bar != nil {
+		p.bar.Add64(n)
+		p.bar.Set("completed", completed)
+	}
+}
+
+// Failed records one failed download attempt; a url that is requeued and
+// fails again is counted again.
+func (p *Progress) Failed() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.failed, 1)
+}
+
+// Report updates the bar's in-flight gauge in ProgressBar mode, and emits
+// one stats record in ProgressJSON mode; it's a no-op in ProgressNone.
+func (p *Progress) Report(queueDepth, inFlight int) {
+	if p == nil {
+		return
+	}
+	if p.bar != nil {
+		p.bar.Set("inflight", inFlight)
+	}
+	if p.Mode != ProgressJSON {
+		return
+	}
+	rec := Stats{
+		Timestamp:  time.Now().Unix(),
+		QueueDepth: queueDepth,
+		InFlight:   inFlight,
+		Completed:  atomic.LoadInt64(&p.completed),
+		Failed:     atomic.LoadInt64(&p.failed),
+		Bytes:      atomic.LoadInt64(&p.bytes),
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// Finish stops the bar, if any, flushing its final render so partial
+// progress stays visible after a SIGINT/SIGTERM.
+func (p *Progress) Finish() {
+	if p == nil || p.bar == nil {
+		return
+	}
+	p.bar.Finish()
+}
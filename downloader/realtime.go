@@ -0,0 +1,136 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jacoblai/rrframework/logs"
+	"github.com/jacoblai/rrframework/storage"
+)
+
+// RealtimeDownloader downloads urls straight off Urls as a source produces
+// them and saves them to Store. Unlike DiskQueueDownloader or
+// RedisDownloader, nothing here survives a restart: urls still buffered in
+// Urls or being downloaded when the process dies are lost.
+type RealtimeDownloader struct {
+	// exported
+	ConcurrencyLimit int                      // max number of goroutines to download
+	Store            rrstorage.StorageWrapper // for saving downloaded binary
+	Urls             <-chan Url               // crawled urls to download
+	UrlChannelFactor int
+	Progress         *Progress // renders run stats; nil is fine, behaves as ProgressNone
+
+	// inner use
+	sema chan struct{} // for concurrency-limiting
+	flag chan struct{} // stop flag
+}
+
+// Start RealtimeDownloader
+func (s *RealtimeDownloader) Start() {
+	s.sema = make(chan struct{}, s.ConcurrencyLimit)
+	s.flag = make(chan struct{})
+
+	tick := time.Tick(2 * time.Second)
+	logs.Info("realtime downloader started.")
+
+loop:
+	for {
+		select {
+		case <-s.flag:
+			// be stopped
+			break loop
+		case s.sema <- struct{}{}:
+			// s.sema not full; wait for either a url or the stop flag, so a
+			// quiet source can't block shutdown forever
+			select {
+			case <-s.flag:
+				<-s.sema
+				break loop
+			case url, ok := <-s.Urls:
+				if !ok {
+					<-s.sema
+					logs.Error("Channel Urls may be closed")
+					break loop
+				}
+				go func() {
+					n, err := s.download(url.V)
+					if err != nil {
+						logs.Error("Download %s fail, %s", url.V, err)
+						s.Progress.Failed()
+					} else {
+						s.Progress.Completed(n)
+					}
+				}()
+			}
+		case <-tick:
+			// report queue depth / in-flight count
+			s.Progress.Report(len(s.Urls), len(s.sema))
+		}
+	}
+}
+
+// Stop RealtimeDownloader
+func (s *RealtimeDownloader) Stop() {
+	close(s.flag)
+}
+
+// download fetches url and saves it to s.Store, returning the number of
+// bytes written.
+func (s *RealtimeDownloader) download(url string) (int64, error) {
+
+	defer func() { <-s.sema }() // release
+
+	logs.Info("Downloading %s", url)
+	client := http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) { return net.DialTimeout(network, addr, 3*time.Second) },
+		},
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, fmt.Errorf("StatusCode %d", response.StatusCode)
+	}
+
+	urlv := strings.Split(url, "/")
+	if len(urlv) < 1 {
+		return 0, fmt.Errorf("invalid url %s", url)
+	}
+	filename := urlv[len(urlv)-1]
+
+	if streamer, ok := s.Store.(StreamStorageWrapper); ok {
+		return streamer.SaveStream(response.Body, filename)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.Store.Save(buf.Bytes(), filename); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -15,44 +15,67 @@
 package downloader
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/jacoblai/rrframework/connector/redis"
 	"github.com/jacoblai/rrframework/logs"
 	"github.com/jacoblai/rrframework/storage"
+
+	"github.com/jacoblai/laosj/queue"
 )
 
 const (
-	URL_CACHE_KEY = URL_KEY_PREFIX + ":DOWNLOADED" // Key for downloaded url cache
+	URL_CACHE_KEY = URL_KEY_PREFIX + ":DOWNLOADED" // prefix for per-url dedup cache keys
+	URL_RETRY_KEY = URL_KEY_PREFIX + ":RETRIES"    // hash of url -> failed attempt count
 )
 
+// cacheKey is the dedup cache key for url; each url gets its own key so
+// RedisDownloader.DedupTTL can expire them individually.
+func cacheKey(url string) string {
+	return URL_CACHE_KEY + ":" + url
+}
+
+// ctx is used for the redis commands issued below; RedisDownloader doesn't
+// thread a per-request context through its API, so a background one is fine.
+var ctx = context.Background()
+
 // RedisDownloader get urls from redis SourceQueue
 // and download them concurrently
 // then save downloaded binary to storage
 type RedisDownloader struct {
 	// exported
 	ConcurrencyLimit int                      // max number of goroutines to download
-	RedisConnStr     string                   // redis connection string
+	RedisConfig      queue.Config             // how to reach redis: standalone, sentinel or cluster
 	SourceQueue      string                   // url queue
 	Store            rrstorage.StorageWrapper // for saving downloaded binary
 	UrlChannelFactor int
+	Progress         *Progress // renders run stats; nil is fine, behaves as ProgressNone
+
+	SkipDownloaded bool          // --resume: also skip urls that already exhausted MaxRetries before a restart
+	DedupTTL       time.Duration // TTL on dedup cache entries; 0 means never expire
+	MaxRetries     int64         // give up on a url after this many retries (MaxRetries+1 failed attempts); 0 means unlimited
+	RetryBackoff   time.Duration // base backoff before requeueing a failed url, doubled per attempt
+	Naming         Naming        // how to name saved files; "" behaves as NamingURL
 
 	// inner use
-	sema chan struct{}        // for concurrency-limiting
-	flag chan struct{}        // stop flag
-	urls chan Url             // url channel queue
-	rc   *rrredis.RedisClient // redis client
+	sema chan struct{} // for concurrency-limiting
+	flag chan struct{} // stop flag
+	urls chan Url      // url channel queue
+	rc   queue.Client  // redis client
 }
 
 // Start RedisDownloader
 func (s *RedisDownloader) Start() {
 	// connect redis
-	err, rc := rrredis.GetRedisClient(s.RedisConnStr)
+	rc, err := queue.New(s.RedisConfig)
 	if err != nil {
 		logs.Error("Start RedisDownloader fail %s", err)
 		return
@@ -66,6 +89,10 @@ func (s *RedisDownloader) Start() {
 
 	go func() {
 		s.getUrlFromSourceQueue()
+		// producer stopped (flag was closed): close s.urls so the stop
+		// branch below can range over it to drain instead of blocking
+		// forever waiting for a value that will never arrive
+		close(s.urls)
 	}()
 
 	tick := time.Tick(2 * time.Second)
@@ -78,7 +105,7 @@ loop2:
 			// be stopped
 			for url := range s.urls {
 				// push back to redis queue
-				if _, err := rc.RPush(s.SourceQueue, url.V); err != nil {
+				if err := rc.RPush(ctx, s.SourceQueue, url.V); err != nil {
 					logs.Error(err)
 				}
 			}
@@ -94,26 +121,25 @@ loop2:
 				break loop2
 			}
 			go func() {
-				if err := s.download(url.V); err != nil {
+				n, err := s.download(url.V)
+				if err != nil {
 					// download fail
-					// push back to redis
 					logs.Error("Download %s fail, %s", url.V, err)
-					if _, err := rc.RPush(s.SourceQueue, url.V); err != nil {
-						logs.Error("Push back to redis failed, %s", err)
-					}
+					s.Progress.Failed()
+					s.retry(rc, url.V)
 				} else {
 					// download success
 					// cache downloaded urls
-					if err := rc.HMSet(URL_CACHE_KEY, map[string]string{
-						url.V: "1",
-					}); err != nil {
+					if err := rc.Set(ctx, cacheKey(url.V), "1", s.DedupTTL); err != nil {
 						logs.Error("cache downloaded url failed, %s", err)
 					}
+					s.Progress.Completed(n)
 				}
 			}()
 		case <-tick:
-			// print this every 2 seconds
-			logs.Info("In queue: %d, doing: %d", len(s.urls), len(s.sema))
+			// report queue depth / in-flight count, replacing the old
+			// every-2-seconds log line
+			s.Progress.Report(len(s.urls), len(s.sema))
 		}
 	}
 
@@ -135,7 +161,7 @@ loop:
 				// TODO there is a chance that last url downloading process be interupted
 				continue
 			}
-			if v, err := s.rc.LLen(s.SourceQueue); err != nil || v != 0 {
+			if v, err := s.rc.LLen(ctx, s.SourceQueue); err != nil || v != 0 {
 				if err != nil {
 					logs.Error(err)
 				}
@@ -146,19 +172,36 @@ loop:
 	}
 }
 
-func (s *RedisDownloader) download(url string) error {
+// download fetches url and saves it to s.Store, returning the number of
+// bytes written.
+func (s *RedisDownloader) download(url string) (int64, error) {
 
 	defer func() { <-s.sema }() // release
 
-	// check if this url is downloaded
-	exist, err := s.rc.HMExists(URL_CACHE_KEY, url)
+	// skip urls already in the dedup cache, regardless of --resume, so a
+	// duplicate url requeued from the source doesn't get re-fetched
+	exist, err := s.rc.Exists(ctx, cacheKey(url))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if exist {
-		// downloaded
 		logs.Info("%s downloaded", url)
-		return nil
+		return 0, nil
+	}
+
+	if s.SkipDownloaded && s.MaxRetries > 0 {
+		// --resume: a process restart loses the in-memory backoff timers
+		// scheduled by retry(), so also skip urls that had already
+		// exhausted their retries before the restart instead of
+		// re-attempting them from scratch
+		attempts, err := s.rc.HIncrBy(ctx, URL_RETRY_KEY, url, 0)
+		if err != nil {
+			return 0, err
+		}
+		if attempts > s.MaxRetries {
+			logs.Info("%s exceeded %d retries, skipping", url, s.MaxRetries)
+			return 0, nil
+		}
 	}
 
 	logs.Info("Downloading %s", url)
@@ -169,36 +212,104 @@ func (s *RedisDownloader) download(url string) error {
 	}
 	response, err := client.Get(url)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		return fmt.Errorf("StatusCode %d", response.StatusCode)
+		return 0, fmt.Errorf("StatusCode %d", response.StatusCode)
 	}
 
-	// read binary from body
-	b, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return err
+	if s.Naming == NamingHash || s.Naming == NamingHashTree {
+		// content-addressed naming needs the full body to hash before it
+		// knows the filename, so it can't use the streaming fast path below
+		return s.downloadContentAddressed(response)
 	}
 
 	urlv := strings.Split(url, "/")
 	if len(urlv) < 1 {
-		return fmt.Errorf("invalid url %s", url)
+		return 0, fmt.Errorf("invalid url %s", url)
 	}
 	filename := urlv[len(urlv)-1]
-	// save binary to storage
-	if err := s.Store.Save(b, filename); err != nil {
-		return err
+
+	// stream straight to the store when it supports it, so large images
+	// don't get buffered fully in memory
+	if streamer, ok := s.Store.(StreamStorageWrapper); ok {
+		return streamer.SaveStream(response.Body, filename)
 	}
-	return nil
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.Store.Save(buf.Bytes(), filename); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// downloadContentAddressed saves response's body under a sha256-derived
+// filename, skipping the save entirely when an identical body (regardless
+// of the url it came from) has already been saved.
+func (s *RedisDownloader) downloadContentAddressed(response *http.Response) (int64, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+
+	isNew, err := s.rc.HSetNX(ctx, URL_HASH_KEY, hash, response.Request.URL.String())
+	if err != nil {
+		return 0, err
+	}
+	if !isNew {
+		logs.Info("%s is a duplicate of an already-saved image (hash %s)", response.Request.URL, hash)
+		return 0, nil
+	}
+
+	filename := hashFilename(s.Naming, hash, response.Header.Get("Content-Type"), response.Request.URL.String())
+	if err := s.Store.Save(buf.Bytes(), filename); err != nil {
+		// the save never happened, so undo the claim: otherwise a retry of
+		// this url (or any other url with the same content) would see
+		// isNew=false above, silently skip saving, and still get marked
+		// downloaded, permanently losing the image
+		if delErr := s.rc.HDel(ctx, URL_HASH_KEY, hash); delErr != nil {
+			logs.Error("rollback hash claim for %s failed, %s", hash, delErr)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// retry bumps url's failed-attempt counter and, unless it has exceeded
+// s.MaxRetries, requeues it after an exponential backoff so a flaky source
+// doesn't get hammered and a permanently-broken url doesn't cycle forever.
+func (s *RedisDownloader) retry(rc queue.Client, url string) {
+	attempts, err := rc.HIncrBy(ctx, URL_RETRY_KEY, url, 1)
+	if err != nil {
+		logs.Error("tracking retries for %s failed, %s", url, err)
+		attempts = 1
+	}
+	if s.MaxRetries > 0 && attempts > s.MaxRetries {
+		logs.Error("%s exceeded %d retries, giving up", url, s.MaxRetries)
+		return
+	}
+	backoff := s.RetryBackoff * time.Duration(int64(1)<<uint(attempts-1))
+	time.AfterFunc(backoff, func() {
+		if err := rc.RPush(ctx, s.SourceQueue, url); err != nil {
+			logs.Error("Push back to redis failed, %s", err)
+		}
+	})
 }
 
 func (s *RedisDownloader) getUrlFromSourceQueue() {
 loop:
 	for {
-		url, err := s.rc.LPop(s.SourceQueue)
-		if err == rrredis.Nil {
+		url, err := s.rc.LPop(ctx, s.SourceQueue)
+		if err == queue.Nil {
 			// empty queue, sleep while
 			time.Sleep(5 * time.Second)
 			// continue the loop
@@ -0,0 +1,108 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3StorageConfig holds the knobs needed to reach an S3-compatible endpoint.
+// AccessKey/SecretKey may be left blank to fall back to the default AWS
+// credential chain (env vars, shared config, instance role, ...).
+type S3StorageConfig struct {
+	Bucket    string
+	Endpoint  string // blank for real AWS S3, set for minio/other S3-compatible stores
+	Region    string
+	Prefix    string // key prefix, no leading slash
+	AccessKey string
+	SecretKey string
+}
+
+// S3Storage implements rrstorage.StorageWrapper (and StreamStorageWrapper) on
+// top of an S3-compatible object store, so RealtimeDownloader and
+// RedisDownloader can save downloaded images without a local disk.
+type S3Storage struct {
+	bucket   string
+	prefix   string
+	uploader *s3manager.Uploader
+}
+
+// NewS3Storage builds an S3Storage from cfg.
+func NewS3Storage(cfg S3StorageConfig) (*S3Storage, error) {
+	awsCfg := aws.NewConfig().WithRegion(cfg.Region)
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if cfg.AccessKey != "" || cfg.SecretKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""))
+	}
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *S3Storage) key(filename string) string {
+	if s.prefix == "" {
+		return filename
+	}
+	return s.prefix + "/" + filename
+}
+
+// Save implements rrstorage.StorageWrapper.
+func (s *S3Storage) Save(b []byte, filename string) error {
+	_, err := s.SaveStream(bytes.NewReader(b), filename)
+	return err
+}
+
+// SaveStream implements StreamStorageWrapper, streaming r straight into a
+// multipart upload instead of buffering it in memory first.
+func (s *S3Storage) SaveStream(r io.Reader, filename string) (int64, error) {
+	counter := &countingReader{r: r}
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(filename)),
+		Body:   counter,
+	})
+	if err != nil {
+		return counter.n, err
+	}
+	return counter.n, nil
+}
+
+// countingReader wraps an io.Reader to track bytes read, since
+// s3manager.Upload only reports success/failure, not byte counts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
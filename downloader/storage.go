@@ -0,0 +1,27 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package downloader
+
+import "io"
+
+// StreamStorageWrapper is an optional extension of rrstorage.StorageWrapper.
+// Backends that can persist a response body without buffering it fully in
+// memory (e.g. object storage doing a multipart upload) should implement it;
+// download() prefers it over rrstorage.StorageWrapper.Save when available.
+type StreamStorageWrapper interface {
+	// SaveStream reads r to completion and persists it under filename,
+	// returning the number of bytes written.
+	SaveStream(r io.Reader, filename string) (int64, error)
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 laosj Author @jacoblai. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue abstracts the handful of Redis commands laosj's downloaders
+// need (LPop/RPush/Set/HIncrBy/...), so they aren't coupled to a single
+// client or a single-instance deployment. It is backed by go-redis/redis/v8
+// and can talk to a standalone instance, a Sentinel-monitored master, or a
+// Cluster.
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Nil is returned by LPop when the queue is empty, mirroring redis.Nil so
+// callers can keep using the familiar "err == queue.Nil" check.
+var Nil = redis.Nil
+
+// Config describes how to reach a Redis deployment. Set Addr alone for a
+// standalone instance; set MasterName+SentinelAddrs for Sentinel failover;
+// set ClusterAddrs for Cluster mode. Password/UseTLS apply to all modes; DB
+// applies to standalone and Sentinel mode only, Cluster mode ignores it.
+type Config struct {
+	Addr     string // host:port, standalone mode
+	Password string
+	DB       int
+	UseTLS   bool
+
+	MasterName    string   // set together with SentinelAddrs to use Sentinel
+	SentinelAddrs []string
+
+	ClusterAddrs []string // set to use Cluster mode
+}
+
+// Client is the subset of Redis commands the downloader and drain command
+// rely on.
+type Client interface {
+	LPop(ctx context.Context, key string) (string, error)
+	RPush(ctx context.Context, key string, value string) error
+	LLen(ctx context.Context, key string) (int64, error)
+
+	// Set/Exists back the per-url dedup cache; ttl of 0 means no expiry.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// HIncrBy backs the per-url retry counter.
+	HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error)
+
+	// HSetNX backs the content-hash dedup map: it reports whether this call
+	// was the one to set field (true = newly set, false = already existed).
+	HSetNX(ctx context.Context, key, field, value string) (bool, error)
+
+	// HDel undoes a HSetNX claim, e.g. when the save it guarded failed.
+	HDel(ctx context.Context, key, field string) error
+
+	Close() error
+}
+
+type client struct {
+	cmd redis.UniversalClient
+}
+
+// New connects to Redis per cfg and pings it, picking standalone, Sentinel
+// or Cluster mode based on which fields are set.
+func New(cfg Config) (Client, error) {
+	var tlsConfig *tls.Config
+	if cfg.UseTLS {
+		tlsConfig = &tls.Config{}
+	}
+
+	var cmd redis.UniversalClient
+	switch {
+	case len(cfg.ClusterAddrs) > 0:
+		cmd = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     cfg.ClusterAddrs,
+			Password:  cfg.Password,
+			TLSConfig: tlsConfig,
+		})
+	case cfg.MasterName != "" && len(cfg.SentinelAddrs) > 0:
+		cmd = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.SentinelAddrs,
+			Password:      cfg.Password,
+			DB:            cfg.DB,
+			TLSConfig:     tlsConfig,
+		})
+	default:
+		cmd = redis.NewClient(&redis.Options{
+			Addr:      cfg.Addr,
+			Password:  cfg.Password,
+			DB:        cfg.DB,
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := cmd.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &client{cmd: cmd}, nil
+}
+
+func (c *client) LPop(ctx context.Context, key string) (string, error) {
+	v, err := c.cmd.LPop(ctx, key).Result()
+	if err == redis.Nil {
+		return "", Nil
+	}
+	return v, err
+}
+
+func (c *client) RPush(ctx context.Context, key string, value string) error {
+	return c.cmd.RPush(ctx, key, value).Err()
+}
+
+func (c *client) LLen(ctx context.Context, key string) (int64, error) {
+	return c.cmd.LLen(ctx, key).Result()
+}
+
+func (c *client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.cmd.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *client) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := c.cmd.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+func (c *client) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	return c.cmd.HIncrBy(ctx, key, field, incr).Result()
+}
+
+func (c *client) HSetNX(ctx context.Context, key, field, value string) (bool, error) {
+	return c.cmd.HSetNX(ctx, key, field, value).Result()
+}
+
+func (c *client) HDel(ctx context.Context, key, field string) error {
+	return c.cmd.HDel(ctx, key, field).Err()
+}
+
+func (c *client) Close() error {
+	return c.cmd.Close()
+}